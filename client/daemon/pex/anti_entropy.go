@@ -0,0 +1,362 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+// BLOCKED ON d7y.io/api: this file's protocol messages (PeerExchangeData and
+// its Digest/DiffRequest/PeerMetadata/Ping oneof) extend the Daemon
+// PeerExchange RPC defined in the external d7y.io/api module. They do not
+// exist in any released d7y.io/api version as of this writing, so this
+// package does not build against the real dependency today. Landing this
+// anti-entropy protocol requires, in order: (1) a PR against d7y.io/api
+// adding the oneof members and regenerating the client/server stubs, (2) a
+// release of that module, (3) a go.mod bump here to depend on it. This file
+// must not be merged ahead of that api change landing; it is written
+// against the dfdaemonv1 surface the api change is expected to produce so
+// that it's ready to build the moment that dependency exists, not as a
+// standalone deliverable. Rolling this out cluster-wide also requires every
+// member to be upgraded past the pre-extension protocol first, since an
+// old server won't recognize the new oneof members.
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	dfdaemonv1 "d7y.io/api/v2/pkg/apis/dfdaemon/v1"
+)
+
+// localSourceIP is the sentinel digestState source used for PeerMetadata
+// originated by this daemon itself, as opposed to one observed from a
+// member's IP. It can never collide with a real member IP, so
+// digestState.evictMember (driven off NotifyLeave, which only ever fires
+// for real members) never prunes our own contributions.
+const localSourceIP = ""
+
+const (
+	// defaultAntiEntropyInterval is the base interval between anti-entropy
+	// reconciliation rounds.
+	defaultAntiEntropyInterval = 30 * time.Second
+
+	// defaultAntiEntropyJitter bounds how much defaultAntiEntropyInterval is
+	// randomized by on each round, to avoid every daemon in a cluster
+	// reconciling in lockstep.
+	defaultAntiEntropyJitter = 0.5
+
+	// defaultAntiEntropyFanout is the number of members contacted on each
+	// anti-entropy round.
+	defaultAntiEntropyFanout = 3
+)
+
+// digestState tracks what the local peerPool believes about the cluster,
+// keyed by taskID, so that a compact digest can be exchanged with a random
+// subset of members without holding peerPool locks across an RPC.
+//
+// The per-task hash is derived from the set of per-(task, peer) hashes
+// currently known, rather than an ever-growing accumulator, so that
+// re-observing the same PeerMetadata (a live push followed by its own
+// anti-entropy resend, a retry, etc.) is a no-op instead of corrupting the
+// digest, and so a peer's contribution can be cleanly removed when its
+// source member is evicted.
+type digestState struct {
+	mu         sync.RWMutex
+	peerHashes map[string]map[string]uint64 // taskID -> peerID -> hash of that peer's last observed PeerMetadata
+	peerSource map[string]map[string]string  // taskID -> peerID -> member IP it was last observed from
+	lastSeen   map[string]*dfdaemonv1.PeerMetadata
+}
+
+func newDigestState() *digestState {
+	return &digestState{
+		peerHashes: make(map[string]map[string]uint64),
+		peerSource: make(map[string]map[string]string),
+		lastSeen:   make(map[string]*dfdaemonv1.PeerMetadata),
+	}
+}
+
+// observe records that peerMetadata is now part of our belief about the
+// cluster, as reported by the member at sourceIP.
+func (d *digestState) observe(sourceIP string, peerMetadata *dfdaemonv1.PeerMetadata) {
+	taskID := peerMetadata.GetTaskId()
+	if taskID == "" {
+		return
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(peerMetadata.String()))
+	sum := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastSeen[taskID] = peerMetadata
+
+	if peerID := peerMetadata.GetPeerId(); peerID != "" {
+		if d.peerHashes[taskID] == nil {
+			d.peerHashes[taskID] = make(map[string]uint64)
+			d.peerSource[taskID] = make(map[string]string)
+		}
+		// Overwriting by peerID (rather than XOR-folding every message ever
+		// seen) makes repeated observations of the same content idempotent.
+		d.peerHashes[taskID][peerID] = sum
+		d.peerSource[taskID][peerID] = sourceIP
+	}
+}
+
+// evictMember drops every per-peer contribution last observed from sourceIP,
+// so a departed member's view of the cluster doesn't linger in the digest or
+// in the pex_peers_total metric forever.
+func (d *digestState) evictMember(sourceIP string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for taskID, sources := range d.peerSource {
+		for peerID, ip := range sources {
+			if ip != sourceIP {
+				continue
+			}
+			delete(sources, peerID)
+			delete(d.peerHashes[taskID], peerID)
+		}
+		if len(sources) == 0 {
+			delete(d.peerSource, taskID)
+			delete(d.peerHashes, taskID)
+			delete(d.lastSeen, taskID)
+		}
+	}
+}
+
+// peerCounts returns the number of distinct peers currently known per task,
+// used to populate the pex_peers_total metric.
+func (d *digestState) peerCounts() map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	counts := make(map[string]int, len(d.peerHashes))
+	for taskID, peers := range d.peerHashes {
+		counts[taskID] = len(peers)
+	}
+	return counts
+}
+
+// snapshot returns a point-in-time copy of the per-task digest, combining
+// every currently known peer hash for a task with XOR so the result is
+// order-independent of the order peers were observed in.
+func (d *digestState) snapshot() map[string]uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	out := make(map[string]uint64, len(d.peerHashes))
+	for taskID, peers := range d.peerHashes {
+		var sum uint64
+		for _, hash := range peers {
+			sum ^= hash
+		}
+		out[taskID] = sum
+	}
+	return out
+}
+
+// diff returns the taskIDs where remote's digest disagrees with ours, either
+// because remote reported a different hash for a task we know about, or the
+// task is only present on one side, so a task we've never received any
+// PeerMetadata for at all is still requested rather than silently skipped.
+func (d *digestState) diff(remote map[string]uint64) []string {
+	local := d.snapshot()
+
+	seen := make(map[string]struct{}, len(local)+len(remote))
+	var missing []string
+	for taskID, sum := range local {
+		seen[taskID] = struct{}{}
+		if remoteSum, ok := remote[taskID]; !ok || remoteSum != sum {
+			missing = append(missing, taskID)
+		}
+	}
+	for taskID := range remote {
+		if _, ok := seen[taskID]; ok {
+			continue
+		}
+		missing = append(missing, taskID)
+	}
+	return missing
+}
+
+// entriesFor returns our last known PeerMetadata for each requested taskID.
+func (d *digestState) entriesFor(taskIDs []string) []*dfdaemonv1.PeerMetadata {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	entries := make([]*dfdaemonv1.PeerMetadata, 0, len(taskIDs))
+	for _, taskID := range taskIDs {
+		if entry, ok := d.lastSeen[taskID]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// runAntiEntropy periodically reconciles a bounded random subset of the
+// current membership against the local digestState, so that a PeerMetadata
+// message dropped by a transient stream error or a race with NotifyJoin is
+// eventually repaired instead of being lost until the peer restarts.
+func (p *peerExchangeMemberManager) runAntiEntropy(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jitter(p.antiEntropyInterval, defaultAntiEntropyJitter)):
+		}
+
+		for _, ip := range p.selectAntiEntropyPeers() {
+			go p.reconcileWithPeer(ip)
+		}
+	}
+}
+
+// selectAntiEntropyPeers picks up to antiEntropyFanout members at random
+// from the currently connected set.
+func (p *peerExchangeMemberManager) selectAntiEntropyPeers() []string {
+	ips := p.connections.ConnectedIPs()
+	if len(ips) <= p.antiEntropyFanout {
+		return ips
+	}
+
+	rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	return ips[:p.antiEntropyFanout]
+}
+
+// reconcileWithPeer sends our current digest to ip over its already
+// established PeerExchange stream. The peer's response, whether a
+// DiffRequest or PeerMetadata entries, is handled asynchronously by the
+// Recv loop already running for that member in pumpStream.
+func (p *peerExchangeMemberManager) reconcileWithPeer(ip string) {
+	sender, ok := p.memberPool.Get(ip)
+	if !ok {
+		p.logger.Debugf("anti-entropy: %s is no longer a member, skipping", ip)
+		return
+	}
+
+	err := sender.Send(&dfdaemonv1.PeerExchangeData{
+		Data: &dfdaemonv1.PeerExchangeData_Digest{
+			Digest: &dfdaemonv1.PeerExchangeDigest{
+				TaskDigests: p.digest.snapshot(),
+			},
+		},
+	})
+	if err != nil {
+		p.logger.Errorf("anti-entropy: failed to send digest to %s: %s", ip, err)
+	}
+}
+
+// handleDigest is invoked when a member proactively offers us its digest. We
+// diff it against our own view and ask only for the tasks that disagree,
+// rather than requesting or pushing the entire peerPool state.
+func (p *peerExchangeMemberManager) handleDigest(node *memberlist.Node, sender peerExchangeSender, remote *dfdaemonv1.PeerExchangeDigest) {
+	missing := p.digest.diff(remote.GetTaskDigests())
+	if len(missing) == 0 {
+		return
+	}
+
+	err := sender.Send(&dfdaemonv1.PeerExchangeData{
+		Data: &dfdaemonv1.PeerExchangeData_DiffRequest{
+			DiffRequest: &dfdaemonv1.PeerExchangeDiffRequest{
+				TaskIds: missing,
+			},
+		},
+	})
+	if err != nil {
+		p.logger.Errorf("anti-entropy: failed to send diff request to %s: %s", node.Addr.String(), err)
+	}
+}
+
+// handleDiffRequest answers a peer's DiffRequest with whatever PeerMetadata
+// we have cached for the requested tasks.
+func (p *peerExchangeMemberManager) handleDiffRequest(node *memberlist.Node, sender peerExchangeSender, req *dfdaemonv1.PeerExchangeDiffRequest) {
+	for _, entry := range p.digest.entriesFor(req.GetTaskIds()) {
+		err := sender.Send(&dfdaemonv1.PeerExchangeData{
+			Data: &dfdaemonv1.PeerExchangeData_PeerMetadata{
+				PeerMetadata: entry,
+			},
+		})
+		if err != nil {
+			p.logger.Errorf("anti-entropy: failed to answer diff request from %s: %s", node.Addr.String(), err)
+			return
+		}
+		p.metrics.observePeerMetadata("sent")
+	}
+}
+
+// runLocalUpdates consumes local piece-completion notifications from
+// peerUpdateChan and pushes each one out to every currently connected
+// member. This is the event-driven counterpart to runAntiEntropy's periodic
+// reconciliation: it's what gets a fresh PeerMetadata to the rest of the
+// cluster immediately instead of waiting for the next anti-entropy round to
+// notice the digest mismatch.
+func (p *peerExchangeMemberManager) runLocalUpdates(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metadata, ok := <-p.peerUpdateChan:
+			if !ok {
+				return
+			}
+			p.broadcastLocalUpdate(metadata)
+		}
+	}
+}
+
+// broadcastLocalUpdate stamps metadata with the current time so that a
+// receiving member can compute propagation latency (see
+// pexMetrics.observePropagationSince), folds it into our own digest so
+// anti-entropy doesn't immediately consider it missing, and pushes it to
+// every currently connected member.
+func (p *peerExchangeMemberManager) broadcastLocalUpdate(metadata *dfdaemonv1.PeerMetadata) {
+	metadata.PushTimestamp = timestamppb.Now()
+	p.digest.observe(localSourceIP, metadata)
+
+	for _, ip := range p.connections.ConnectedIPs() {
+		sender, ok := p.memberPool.Get(ip)
+		if !ok {
+			continue
+		}
+
+		err := sender.Send(&dfdaemonv1.PeerExchangeData{
+			Data: &dfdaemonv1.PeerExchangeData_PeerMetadata{
+				PeerMetadata: metadata,
+			},
+		})
+		if err != nil {
+			p.logger.Errorf("failed to push local peer update to %s: %s", ip, err)
+			continue
+		}
+		p.metrics.observePeerMetadata("sent")
+	}
+}
+
+// jitter returns d randomized by up to +/- fraction, so peers in a cluster
+// don't all run anti-entropy rounds in lockstep.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	delta := time.Duration(fraction * float64(d))
+	return d - delta + time.Duration(rand.Int63n(int64(2*delta+1)))
+}
@@ -0,0 +1,88 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"testing"
+
+	dfdaemonv1 "d7y.io/api/v2/pkg/apis/dfdaemon/v1"
+)
+
+func TestDigestStateObserveIsIdempotent(t *testing.T) {
+	d := newDigestState()
+	meta := &dfdaemonv1.PeerMetadata{TaskId: "task-1", PeerId: "peer-1"}
+
+	d.observe("10.0.0.1", meta)
+	before := d.snapshot()["task-1"]
+
+	// Re-observing identical content, e.g. a live push followed by its own
+	// anti-entropy resend, must not change the digest.
+	d.observe("10.0.0.1", meta)
+	after := d.snapshot()["task-1"]
+
+	if before != after {
+		t.Fatalf("re-observing identical PeerMetadata changed the digest: before=%d after=%d", before, after)
+	}
+}
+
+func TestDigestStateDiffCoversRemoteOnlyTasks(t *testing.T) {
+	d := newDigestState()
+	d.observe("10.0.0.1", &dfdaemonv1.PeerMetadata{TaskId: "task-local", PeerId: "peer-1"})
+
+	// "task-remote" is a task we've never received any PeerMetadata for at
+	// all, simulating an original push that was dropped entirely.
+	remote := map[string]uint64{"task-remote": 42}
+
+	missing := d.diff(remote)
+	if !containsString(missing, "task-remote") {
+		t.Fatalf("diff() = %v, want it to include task-remote", missing)
+	}
+	if !containsString(missing, "task-local") {
+		t.Fatalf("diff() = %v, want it to include task-local (absent from remote)", missing)
+	}
+}
+
+func TestDigestStateEvictMemberDropsItsContributions(t *testing.T) {
+	d := newDigestState()
+	d.observe("10.0.0.1", &dfdaemonv1.PeerMetadata{TaskId: "task-1", PeerId: "peer-from-1"})
+	d.observe("10.0.0.2", &dfdaemonv1.PeerMetadata{TaskId: "task-1", PeerId: "peer-from-2"})
+
+	if got := d.peerCounts()["task-1"]; got != 2 {
+		t.Fatalf("peerCounts()[task-1] = %d, want 2", got)
+	}
+
+	d.evictMember("10.0.0.1")
+
+	if got := d.peerCounts()["task-1"]; got != 1 {
+		t.Fatalf("peerCounts()[task-1] after evict = %d, want 1", got)
+	}
+
+	d.evictMember("10.0.0.2")
+
+	if _, ok := d.peerCounts()["task-1"]; ok {
+		t.Fatalf("peerCounts() still reports task-1 once all its peers are evicted")
+	}
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,419 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"google.golang.org/grpc/keepalive"
+
+	dfdaemonv1 "d7y.io/api/v2/pkg/apis/dfdaemon/v1"
+)
+
+// pexKeepaliveParams configures gRPC-level keepalive for PEX connections, on
+// top of the application-level ping run by runHealthCheck, so that a
+// half-open TCP connection is detected even if nothing is flowing on it.
+var pexKeepaliveParams = keepalive.ClientParameters{
+	Time:                healthCheckInterval,
+	Timeout:             5 * time.Second,
+	PermitWithoutStream: true,
+}
+
+// connectionState is the lifecycle of a single PEX member connection.
+type connectionState int32
+
+const (
+	// StateConnecting is set while the initial or a retried dial is
+	// in flight.
+	StateConnecting connectionState = iota
+	// StateConnected is set once the PeerExchange stream is up and its
+	// Recv loop is pumping messages.
+	StateConnected
+	// StateBackoff is set after a dial or stream failure, while the
+	// connection waits out its backoff before retrying.
+	StateBackoff
+	// StateClosed is set once the member has left or the manager has
+	// given up on it; it will not be retried.
+	StateClosed
+)
+
+func (s connectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// healthCheckInterval is how often a lightweight application-level ping
+	// is sent on an established PeerExchange stream.
+	healthCheckInterval = 15 * time.Second
+
+	// initialReconnectBackoff and maxReconnectBackoff bound the exponential
+	// backoff used to retry a failed connection.
+	initialReconnectBackoff = time.Second
+	maxReconnectBackoff     = 2 * time.Minute
+)
+
+// ConnectionInfo is a point-in-time snapshot of a PEX member connection,
+// returned by connectionManager.Inspect for operators.
+type ConnectionInfo struct {
+	IP       string
+	RpcPort  uint32
+	State    string
+	Attempts int
+}
+
+// memberConnection tracks the retry state machine for a single member.
+type memberConnection struct {
+	mu       sync.Mutex
+	meta     *MemberMeta
+	node     *memberlist.Node
+	state    connectionState
+	attempts int
+	cancel   context.CancelFunc
+}
+
+func (c *memberConnection) setState(state connectionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+}
+
+func (c *memberConnection) currentState() connectionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// connectionManager owns per-member connection state and drives its
+// transitions from memberlist callbacks, retrying failed connections with
+// exponential backoff instead of waiting for another memberlist event.
+//
+// conns is keyed by memberlist.Node.Name, the member's stable cluster
+// identity, rather than its advertised IP: the IP is exactly the thing that
+// can change under us (see Update), so keying by it would make a changed-IP
+// member unreachable under its old key and indistinguishable from a brand
+// new member under its new one.
+type connectionManager struct {
+	manager *peerExchangeMemberManager
+
+	mu    sync.RWMutex
+	conns map[string]*memberConnection
+}
+
+func newConnectionManager(p *peerExchangeMemberManager) *connectionManager {
+	return &connectionManager{
+		manager: p,
+		conns:   make(map[string]*memberConnection),
+	}
+}
+
+// Start begins connecting to node if it isn't already being tracked.
+func (c *connectionManager) Start(node *memberlist.Node) {
+	member, err := c.manager.verifiedNodeMeta(node)
+	if err != nil {
+		c.manager.logger.Errorf("failed to extract node meta %s: %s", string(node.Meta), err)
+		c.manager.metrics.observeSyncError(causeDecodeError)
+		return
+	}
+
+	c.mu.Lock()
+	if existing, ok := c.conns[node.Name]; ok && existing.currentState() != StateClosed {
+		c.mu.Unlock()
+		c.manager.logger.Debugf("node %s is already %s", member.IP, existing.currentState())
+		c.manager.metrics.observeDuplicateSuppressed()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &memberConnection{meta: member, node: node, state: StateConnecting, cancel: cancel}
+	c.conns[node.Name] = conn
+	c.mu.Unlock()
+
+	go c.run(ctx, conn)
+}
+
+// Stop tears down the connection tracked for node, evicting its
+// contributions from the peerPool and marking it Closed so it will not be
+// retried. conn.cancel() is the ctx passed all the way down to the gRPC
+// dial and to the PeerExchange stream itself (see dialMember), so it
+// terminates a live stream and unblocks a pumpStream Recv() blocked on it,
+// rather than merely stopping future reconnect attempts while the old
+// stream's goroutine keeps running and resurrecting evicted state. Eviction
+// uses the meta cached when the connection was established, not node's
+// current advertisement, since by the time Stop is called for an
+// Update-triggered teardown node may already carry the new (post-change)
+// metadata.
+func (c *connectionManager) Stop(node *memberlist.Node) {
+	c.mu.Lock()
+	conn, ok := c.conns[node.Name]
+	delete(c.conns, node.Name)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	conn.setState(StateClosed)
+	conn.cancel()
+
+	conn.mu.Lock()
+	member := conn.meta
+	conn.mu.Unlock()
+
+	c.manager.memberPool.Unregister(member.IP)
+	c.manager.peerPool.EvictMember(member.IP)
+	c.manager.digest.evictMember(member.IP)
+}
+
+// Update compares node's advertised metadata against the cached copy and,
+// if its RpcPort or IP changed, tears down the existing connection and
+// reconnects to the new endpoint.
+func (c *connectionManager) Update(node *memberlist.Node) {
+	member, err := c.manager.verifiedNodeMeta(node)
+	if err != nil {
+		c.manager.logger.Errorf("failed to extract node meta %s: %s", string(node.Meta), err)
+		return
+	}
+
+	c.mu.RLock()
+	conn, ok := c.conns[node.Name]
+	c.mu.RUnlock()
+	if !ok {
+		c.Start(node)
+		return
+	}
+
+	conn.mu.Lock()
+	previousIP := conn.meta.IP
+	changed := conn.meta.RpcPort != member.RpcPort || conn.meta.IP != member.IP
+	conn.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	c.manager.logger.Infof("node %s endpoint changed (now %s), reconnecting", previousIP, member.IP)
+	c.Stop(node)
+	c.Start(node)
+}
+
+// ReconnectAll tears down and restarts every tracked connection, used when
+// the manager's dial credentials change (e.g. certificate rotation).
+func (c *connectionManager) ReconnectAll() {
+	c.mu.RLock()
+	nodes := make([]*memberlist.Node, 0, len(c.conns))
+	for _, conn := range c.conns {
+		nodes = append(nodes, conn.node)
+	}
+	c.mu.RUnlock()
+
+	for _, node := range nodes {
+		c.Stop(node)
+		c.Start(node)
+	}
+}
+
+// ConnectedIPs returns the IPs of members currently in StateConnected, used
+// to pick the fan-out set for anti-entropy rounds.
+func (c *connectionManager) ConnectedIPs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var ips []string
+	for _, conn := range c.conns {
+		if conn.currentState() != StateConnected {
+			continue
+		}
+		conn.mu.Lock()
+		ips = append(ips, conn.meta.IP)
+		conn.mu.Unlock()
+	}
+	return ips
+}
+
+// Inspect returns a snapshot of every tracked connection's state, for
+// operator-facing status endpoints.
+func (c *connectionManager) Inspect() []ConnectionInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	infos := make([]ConnectionInfo, 0, len(c.conns))
+	for _, conn := range c.conns {
+		conn.mu.Lock()
+		infos = append(infos, ConnectionInfo{
+			IP:       conn.meta.IP,
+			RpcPort:  conn.meta.RpcPort,
+			State:    conn.state.String(),
+			Attempts: conn.attempts,
+		})
+		conn.mu.Unlock()
+	}
+	return infos
+}
+
+// run drives conn through repeated dial/serve/backoff cycles until ctx is
+// cancelled, so a stream failure detected by the health checker reconnects
+// after a reconnectBackoff delay instead of waiting for another memberlist
+// event.
+func (c *connectionManager) run(ctx context.Context, conn *memberConnection) {
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		conn.setState(StateConnecting)
+		err := c.manager.serveConnection(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.manager.logger.Errorf("pex connection to %s failed: %s", conn.meta.IP, err)
+		}
+
+		conn.mu.Lock()
+		conn.attempts++
+		backoff := reconnectBackoff(conn.attempts)
+		conn.mu.Unlock()
+		conn.setState(StateBackoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// reconnectBackoff returns an exponential backoff capped at
+// maxReconnectBackoff and randomized by up to +/-20% to avoid a thundering
+// herd of reconnects after a shared outage.
+func reconnectBackoff(attempts int) time.Duration {
+	backoff := initialReconnectBackoff << attempts
+	if backoff <= 0 || backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+	return jitter(backoff, 0.2)
+}
+
+// serveConnection dials member, registers it, and pumps its PeerExchange
+// stream until it fails or ctx is cancelled. It also owns the health
+// checker for the lifetime of the stream.
+func (p *peerExchangeMemberManager) serveConnection(ctx context.Context, conn *memberConnection) error {
+	member := conn.meta
+
+	if p.memberPool.IsRegistered(member.IP) {
+		p.metrics.observeDuplicateSuppressed()
+		return nil
+	}
+
+	grpcClient, peerExchangeClient, err := p.dialMember(ctx, member)
+	if err != nil {
+		return err
+	}
+
+	closeFunc := func() error {
+		_ = peerExchangeClient.CloseSend()
+		return grpcClient.Close()
+	}
+
+	err = p.memberPool.Register(member.IP, NewPeerMetadataSendReceiveCloser(peerExchangeClient, closeFunc))
+	if errors.Is(err, ErrIsAlreadyExists) {
+		_ = closeFunc()
+		p.metrics.observeSyncError(causeAlreadyRegistered)
+		return nil
+	}
+	if err != nil {
+		_ = closeFunc()
+		return err
+	}
+	defer func() { _ = closeFunc() }()
+
+	conn.setState(StateConnected)
+	conn.mu.Lock()
+	conn.attempts = 0
+	conn.mu.Unlock()
+
+	healthCtx, cancelHealth := context.WithCancel(ctx)
+	defer cancelHealth()
+	go p.runHealthCheck(healthCtx, member.IP, peerExchangeClient)
+
+	return p.pumpStream(conn.node, member, peerExchangeClient)
+}
+
+// pumpStream reads messages off peerExchangeClient until it errors,
+// dispatching each to the appropriate handler.
+func (p *peerExchangeMemberManager) pumpStream(node *memberlist.Node, member *MemberMeta, peerExchangeClient dfdaemonv1.Daemon_PeerExchangeClient) error {
+	for {
+		msg, err := peerExchangeClient.Recv()
+		if err != nil {
+			p.metrics.observeSyncError(causeStreamClosed)
+			return err
+		}
+
+		switch payload := msg.GetData().(type) {
+		case *dfdaemonv1.PeerExchangeData_PeerMetadata:
+			p.metrics.observePeerMetadata("received")
+			if pushedAt := payload.PeerMetadata.GetPushTimestamp(); pushedAt != nil {
+				p.metrics.observePropagationSince(pushedAt.AsTime())
+			}
+			p.digest.observe(member.IP, payload.PeerMetadata)
+			p.peerPool.Sync(member, payload.PeerMetadata)
+		case *dfdaemonv1.PeerExchangeData_Digest:
+			p.handleDigest(node, peerExchangeClient, payload.Digest)
+		case *dfdaemonv1.PeerExchangeData_DiffRequest:
+			p.handleDiffRequest(node, peerExchangeClient, payload.DiffRequest)
+		case *dfdaemonv1.PeerExchangeData_Ping:
+			// application-level liveness probe, no payload to act on.
+		}
+	}
+}
+
+// runHealthCheck sends a lightweight application-level ping on the stream
+// every healthCheckInterval. A failed send lets the reconnect loop in run
+// notice the dead connection without waiting for the next memberlist event;
+// gRPC-level keepalive (configured on the dial options) covers the case
+// where the TCP connection itself goes silent.
+func (p *peerExchangeMemberManager) runHealthCheck(ctx context.Context, ip string, sender peerExchangeSender) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sender.Send(&dfdaemonv1.PeerExchangeData{
+				Data: &dfdaemonv1.PeerExchangeData_Ping{Ping: &dfdaemonv1.PeerExchangePing{}},
+			}); err != nil {
+				p.logger.Debugf("health check ping to %s failed: %s", ip, err)
+				return
+			}
+		}
+	}
+}
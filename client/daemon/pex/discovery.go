@@ -0,0 +1,297 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	dflogger "d7y.io/dragonfly/v2/internal/dflog"
+)
+
+var discoveryLogger = dflogger.With("component", "pexMemberDiscovery")
+
+// defaultDiscoveryInterval is how often a MemberDiscovery backend is
+// re-resolved when it doesn't push updates on its own (DNS, static file).
+const defaultDiscoveryInterval = 30 * time.Second
+
+// MemberDiscovery resolves the current set of PEX seed addresses to join,
+// replacing memberlist's assumption of reachable UDP multicast or a
+// hard-coded seed list.
+type MemberDiscovery interface {
+	// Resolve returns the currently known "host:port" addresses.
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// MemberlistJoiner is the subset of *memberlist.Memberlist used to bring
+// newly discovered addresses into the cluster. It is satisfied directly by
+// *memberlist.Memberlist.
+type MemberlistJoiner interface {
+	Join(existing []string) (int, error)
+}
+
+// SetJoiner binds the memberlist instance that runDiscovery issues Join
+// calls against. It must be called once the *memberlist.Memberlist has been
+// created with this manager installed as its event delegate, since the two
+// have a construction-order dependency on each other: runDiscovery may
+// already be running (and resolving addresses) by the time this is called,
+// so it wakes the discovery loop to join immediately instead of leaving it
+// to wait out the rest of its current interval.
+func (p *peerExchangeMemberManager) SetJoiner(joiner MemberlistJoiner) {
+	p.joinerMu.Lock()
+	p.joiner = joiner
+	p.joinerMu.Unlock()
+
+	select {
+	case p.joinerReady <- struct{}{}:
+	default:
+	}
+}
+
+// getJoiner returns the currently bound joiner, or nil if SetJoiner hasn't
+// been called yet.
+func (p *peerExchangeMemberManager) getJoiner() MemberlistJoiner {
+	p.joinerMu.RLock()
+	defer p.joinerMu.RUnlock()
+	return p.joiner
+}
+
+// runDiscovery periodically resolves memberDiscovery and passes every
+// resolved address to Join, so the cluster can self-heal from a full
+// partition (or a cold start where no peer is reachable yet) without
+// operator intervention. Resolved addresses are not diffed against the
+// current membership, so already-joined members are joined again each round.
+func (p *peerExchangeMemberManager) runDiscovery(ctx context.Context) {
+	if p.memberDiscovery == nil {
+		return
+	}
+
+	attempts := 0
+	for {
+		addrs, err := p.memberDiscovery.Resolve(ctx)
+		if err != nil {
+			attempts++
+			p.logger.Errorf("member discovery failed: %s", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reconnectBackoff(attempts)):
+				continue
+			}
+		}
+		attempts = 0
+
+		if joiner := p.getJoiner(); len(addrs) > 0 && joiner != nil {
+			if n, err := joiner.Join(addrs); err != nil {
+				p.logger.Errorf("failed to join discovered members: %s", err)
+			} else {
+				p.logger.Debugf("joined %d/%d discovered members", n, len(addrs))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.joinerReady:
+			// SetJoiner just became available: re-resolve and join right
+			// away instead of waiting out the rest of this interval, so
+			// cold-start bootstrapping isn't stalled by construction order.
+		case <-time.After(defaultDiscoveryInterval):
+		}
+	}
+}
+
+// dnsMemberDiscovery resolves seed addresses by periodically polling a DNS
+// name, preferring SRV records (which carry a port) and falling back to
+// plain A/AAAA records combined with a fixed port.
+type dnsMemberDiscovery struct {
+	resolver *net.Resolver
+	name     string
+	port     int
+}
+
+// NewDNSMemberDiscovery builds a MemberDiscovery that resolves name (a
+// headless Kubernetes Service name, or any DNS name backed by SRV or
+// A/AAAA records) on each Resolve call.
+func NewDNSMemberDiscovery(name string, port int) MemberDiscovery {
+	return &dnsMemberDiscovery{resolver: net.DefaultResolver, name: name, port: port}
+}
+
+func (d *dnsMemberDiscovery) Resolve(ctx context.Context) ([]string, error) {
+	if _, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name); err == nil && len(srvs) > 0 {
+		addrs := make([]string, 0, len(srvs))
+		for _, srv := range srvs {
+			addrs = append(addrs, net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+		}
+		return addrs, nil
+	}
+
+	ips, err := d.resolver.LookupIPAddr(ctx, d.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", d.name, err)
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(d.port)))
+	}
+	return addrs, nil
+}
+
+// staticMemberDiscovery serves a fixed list of addresses that can be
+// replaced at runtime, driven by WatchSIGHUP reloading from a file.
+type staticMemberDiscovery struct {
+	mu    sync.RWMutex
+	addrs []string
+}
+
+// NewStaticMemberDiscovery returns a MemberDiscovery seeded with addrs,
+// which can later be replaced with Reload (typically wired to SIGHUP).
+func NewStaticMemberDiscovery(addrs []string) *staticMemberDiscovery {
+	return &staticMemberDiscovery{addrs: addrs}
+}
+
+func (s *staticMemberDiscovery) Resolve(_ context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.addrs...), nil
+}
+
+// Reload replaces the served address list.
+func (s *staticMemberDiscovery) Reload(addrs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addrs = addrs
+}
+
+// WatchSIGHUP reloads the static member list from path every time the
+// process receives SIGHUP, until ctx is cancelled. Each line of path is
+// expected to be one "host:port" address.
+func (s *staticMemberDiscovery) WatchSIGHUP(ctx context.Context, path string) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			addrs, err := readAddrFile(path)
+			if err != nil {
+				discoveryLogger.Errorf("failed to reload member list from %s: %s", path, err)
+				continue
+			}
+			s.Reload(addrs)
+		}
+	}
+}
+
+func readAddrFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addrs = append(addrs, line)
+	}
+	return addrs, nil
+}
+
+// k8sMemberDiscovery watches a Service's Endpoints via a client-go informer
+// and serves the most recently observed set of pod addresses, so the PEX
+// cluster can bootstrap in a Kubernetes deployment where multicast and
+// hard-coded seed lists don't work.
+type k8sMemberDiscovery struct {
+	mu      sync.RWMutex
+	addrs   []string
+	rpcPort int
+
+	stopCh chan struct{}
+}
+
+// NewKubernetesMemberDiscovery watches the Endpoints for namespace/service
+// on clientset and resolves to the RpcPort on each ready pod address.
+func NewKubernetesMemberDiscovery(clientset kubernetes.Interface, namespace, service string, rpcPort int) MemberDiscovery {
+	d := &k8sMemberDiscovery{stopCh: make(chan struct{}), rpcPort: rpcPort}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = "metadata.name=" + service
+		}),
+	)
+	informer := factory.Core().V1().Endpoints().Informer()
+	_, _ = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { d.update(obj) },
+		UpdateFunc: func(_, obj any) { d.update(obj) },
+		DeleteFunc: func(any) { d.update(&corev1.Endpoints{}) },
+	})
+
+	go informer.Run(d.stopCh)
+
+	return d
+}
+
+func (d *k8sMemberDiscovery) update(obj any) {
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok {
+		return
+	}
+
+	var addrs []string
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			addrs = append(addrs, net.JoinHostPort(addr.IP, strconv.Itoa(d.rpcPort)))
+		}
+	}
+
+	d.mu.Lock()
+	d.addrs = addrs
+	d.mu.Unlock()
+}
+
+func (d *k8sMemberDiscovery) Resolve(_ context.Context) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]string(nil), d.addrs...), nil
+}
+
+// Stop releases the informer goroutine backing this discovery backend.
+func (d *k8sMemberDiscovery) Stop() {
+	close(d.stopCh)
+}
@@ -0,0 +1,89 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStaticMemberDiscoveryReload(t *testing.T) {
+	s := NewStaticMemberDiscovery([]string{"10.0.0.1:65000"})
+
+	got, err := s.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, []string{"10.0.0.1:65000"}) {
+		t.Fatalf("Resolve() = %v, want [10.0.0.1:65000]", got)
+	}
+
+	s.Reload([]string{"10.0.0.2:65000", "10.0.0.3:65000"})
+
+	got, err = s.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Resolve() after Reload() failed: %s", err)
+	}
+	if !reflect.DeepEqual(got, []string{"10.0.0.2:65000", "10.0.0.3:65000"}) {
+		t.Fatalf("Resolve() after Reload() = %v, want [10.0.0.2:65000 10.0.0.3:65000]", got)
+	}
+}
+
+func TestReadAddrFileSkipsBlankLinesAndComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrs.txt")
+	contents := "10.0.0.1:65000\n# a comment\n\n10.0.0.2:65000\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write test file: %s", err)
+	}
+
+	addrs, err := readAddrFile(path)
+	if err != nil {
+		t.Fatalf("readAddrFile() failed: %s", err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"10.0.0.1:65000", "10.0.0.2:65000"}) {
+		t.Fatalf("readAddrFile() = %v, want [10.0.0.1:65000 10.0.0.2:65000]", addrs)
+	}
+}
+
+// setJoinerFixture satisfies MemberlistJoiner for SetJoiner/getJoiner tests
+// without depending on a real *memberlist.Memberlist.
+type setJoinerFixture struct{}
+
+func (setJoinerFixture) Join(_ []string) (int, error) { return 0, nil }
+
+func TestSetJoinerWakesPendingDiscoveryLoop(t *testing.T) {
+	p := &peerExchangeMemberManager{joinerReady: make(chan struct{}, 1)}
+
+	if got := p.getJoiner(); got != nil {
+		t.Fatalf("getJoiner() = %v before SetJoiner, want nil", got)
+	}
+
+	p.SetJoiner(setJoinerFixture{})
+
+	if got := p.getJoiner(); got == nil {
+		t.Fatalf("getJoiner() = nil after SetJoiner, want the joiner set")
+	}
+
+	select {
+	case <-p.joinerReady:
+	default:
+		t.Fatalf("SetJoiner did not signal joinerReady")
+	}
+}
@@ -18,15 +18,18 @@ package pex
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/memberlist"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 
 	dfdaemonv1 "d7y.io/api/v2/pkg/apis/dfdaemon/v1"
 	logger "d7y.io/dragonfly/v2/internal/dflog"
@@ -41,38 +44,156 @@ type peerExchangeMemberManager struct {
 	GRPCDialTimeout time.Duration
 	peerUpdateChan  <-chan *dfdaemonv1.PeerMetadata
 
-	nodes      sync.Map
+	// certificateSource, when set, provides the TLS configuration used to
+	// dial other PEX members and notifies us on certificate rotation so
+	// that existing connections can be re-dialed with fresh credentials.
+	certificateSource CertificateSource
+	tlsConfig         atomic.Pointer[tls.Config]
+
+	// antiEntropyInterval and antiEntropyFanout tune the periodic push-pull
+	// reconciliation that runs in addition to the event-driven stream, see
+	// runAntiEntropy.
+	antiEntropyInterval time.Duration
+	antiEntropyFanout   int
+	digest              *digestState
+
+	// gossipKeyring, when set, enables symmetric encryption of memberlist
+	// gossip. metaSecurity, when set, enables signing/verification of the
+	// advertised MemberMeta.
+	gossipKeyring *gossipKeyring
+	metaSecurity  *metaSecurity
+
+	// metrics is nil unless WithPrometheusRegisterer is used.
+	metrics *pexMetrics
+
+	// memberDiscovery and joiner back the pluggable bootstrap path; see
+	// runDiscovery and SetJoiner. joiner is set asynchronously, after
+	// runDiscovery has already started, so it's guarded by joinerMu rather
+	// than being a plain field; joinerReady wakes runDiscovery up as soon as
+	// SetJoiner runs instead of leaving it to wait out the rest of the
+	// current discovery interval.
+	memberDiscovery MemberDiscovery
+	joinerMu        sync.RWMutex
+	joiner          MemberlistJoiner
+	joinerReady     chan struct{}
+
+	cancel      func()
+	connections *connectionManager
+
 	peerPool   *peerPool
 	memberPool *memberPool
 }
 
-func newPeerExchangeMemberManager(peerUpdateChan <-chan *dfdaemonv1.PeerMetadata) *peerExchangeMemberManager {
-	return &peerExchangeMemberManager{
-		logger:          logger.With("component", "peerExchangeCluster"),
-		GRPCCredentials: nil, // TODO
-		GRPCDialTimeout: 0,   // TODO
-		peerUpdateChan:  peerUpdateChan,
-		nodes:           sync.Map{},
-		peerPool:        newPeerPool(),
-		memberPool:      newMemberPool(),
+// peerExchangeSender is the subset of dfdaemonv1.Daemon_PeerExchangeClient
+// used to push anti-entropy protocol messages back to a member over its
+// already established PeerExchange stream.
+type peerExchangeSender interface {
+	Send(*dfdaemonv1.PeerExchangeData) error
+}
+
+// NewPeerExchangeMemberManager builds the memberlist.EventDelegate that
+// backs the PEX subsystem, applying opts (WithCertificateSource,
+// WithGossipEncryption, WithSignedMeta, WithMemberDiscovery, ...) to
+// configure it. peerUpdateChan feeds local piece-completion updates that
+// should be pushed out to other members. Daemon startup is responsible for
+// constructing this with whichever options its configuration enables and
+// for calling SetJoiner once the memberlist.Memberlist it's installed on
+// has been created.
+func NewPeerExchangeMemberManager(peerUpdateChan <-chan *dfdaemonv1.PeerMetadata, opts ...Option) *peerExchangeMemberManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := &peerExchangeMemberManager{
+		logger:              logger.With("component", "peerExchangeCluster"),
+		GRPCCredentials:     insecure.NewCredentials(),
+		GRPCDialTimeout:     defaultGRPCDialTimeout,
+		peerUpdateChan:      peerUpdateChan,
+		antiEntropyInterval: defaultAntiEntropyInterval,
+		antiEntropyFanout:   defaultAntiEntropyFanout,
+		digest:              newDigestState(),
+		joinerReady:         make(chan struct{}, 1),
+		cancel:              cancel,
+		peerPool:            newPeerPool(),
+		memberPool:          newMemberPool(),
+	}
+	p.connections = newConnectionManager(p)
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.certificateSource != nil {
+		go p.watchCertificateRotation(ctx)
+	}
+	go p.runAntiEntropy(ctx)
+	go p.runLocalUpdates(ctx)
+	go p.runMetricsRefresh(ctx)
+	go p.runDiscovery(ctx)
+
+	return p
+}
+
+// Stop tears down background goroutines owned by the manager, such as
+// certificate-rotation watching and periodic anti-entropy reconciliation.
+func (p *peerExchangeMemberManager) Stop() {
+	p.cancel()
+}
+
+// InspectConnections returns a snapshot of every known PEX member and its
+// connection state, for operator-facing status endpoints.
+func (p *peerExchangeMemberManager) InspectConnections() []ConnectionInfo {
+	return p.connections.Inspect()
+}
+
+// Keyring returns the memberlist.Keyring configured via
+// WithGossipEncryption, for daemon startup to install on memberlist.Config,
+// or nil if gossip encryption is disabled.
+func (p *peerExchangeMemberManager) Keyring() *memberlist.Keyring {
+	if p.gossipKeyring == nil {
+		return nil
+	}
+	return p.gossipKeyring.keyring
+}
+
+// RotateGossipKey installs newKey as the primary gossip encryption key,
+// retaining the previous primary for the configured grace period. It returns
+// an error if gossip encryption was not enabled via WithGossipEncryption.
+func (p *peerExchangeMemberManager) RotateGossipKey(newKey []byte) error {
+	if p.gossipKeyring == nil {
+		return errors.New("gossip encryption is not enabled")
+	}
+	return p.gossipKeyring.RotateKey(newKey)
+}
+
+// watchCertificateRotation listens for renewed certificates from
+// certificateSource and re-dials every currently connected PEX member so
+// that none of them keep authenticating with an expired certificate.
+func (p *peerExchangeMemberManager) watchCertificateRotation(ctx context.Context) {
+	for cfg := range p.certificateSource.Subscribe(ctx) {
+		p.logger.Infof("pex certificate rotated, reconnecting members with updated credentials")
+		p.tlsConfig.Store(cfg)
+		p.connections.ReconnectAll()
 	}
 }
 
 func (p *peerExchangeMemberManager) NotifyJoin(node *memberlist.Node) {
 	addr := node.Addr.String()
 	p.logger.Infof("peer %s joined", addr)
-	go p.syncNode(node)
+	p.metrics.observeMemberEvent("join")
+	p.connections.Start(node)
 }
 
 func (p *peerExchangeMemberManager) NotifyLeave(node *memberlist.Node) {
 	addr := node.Addr.String()
 	p.logger.Infof("peer %s leaved", addr)
-	// TODO
+	p.metrics.observeMemberEvent("leave")
+	p.connections.Stop(node)
 }
 
 func (p *peerExchangeMemberManager) NotifyUpdate(node *memberlist.Node) {
 	addr := node.Addr.String()
 	p.logger.Infof("peer %s updated", addr)
+	p.metrics.observeMemberEvent("update")
+	p.connections.Update(node)
 }
 
 func ExtractNodeMeta(node *memberlist.Node) (*MemberMeta, error) {
@@ -88,46 +209,12 @@ func ExtractNodeMeta(node *memberlist.Node) (*MemberMeta, error) {
 	return nodeMeta, nil
 }
 
-func (p *peerExchangeMemberManager) syncNode(node *memberlist.Node) {
-	member, err := ExtractNodeMeta(node)
-	if err != nil {
-		p.logger.Errorf("failed to extract node meta %s: %s", string(node.Meta), err)
-		return
-	}
-
-	if p.memberPool.IsRegistered(member.IP) {
-		p.logger.Debugf("node %s is already registered", member.IP)
-		return
-	}
-
-	grpcClient, peerExchangeClient, err := p.dialMember(member)
-	if err != nil {
-		p.logger.Errorf("failed to dial %s: %s", node.Addr.String(), err)
-		return
-	}
-
-	closeFunc := func() error {
-		_ = peerExchangeClient.CloseSend()
-		return grpcClient.Close()
-	}
-
-	err = p.memberPool.Register(member.IP, NewPeerMetadataSendReceiveCloser(peerExchangeClient, closeFunc))
-	if errors.Is(err, ErrIsAlreadyExists) {
-		p.logger.Debugf("node %s is already registered", member.IP)
-		return
-	}
-
-	var peerMetadata *dfdaemonv1.PeerMetadata
-	for {
-		peerMetadata, err = peerExchangeClient.Recv()
-		if err != nil {
-			return
-		}
-		p.peerPool.Sync(member, peerMetadata)
-	}
-}
-
-func (p *peerExchangeMemberManager) dialMember(meta *MemberMeta) (dfdaemonclient.V1, dfdaemonv1.Daemon_PeerExchangeClient, error) {
+// dialMember dials meta and opens its PeerExchange stream with ctx as the
+// stream's parent, so cancelling ctx (as connectionManager.Stop does via
+// memberConnection.cancel) unblocks a pumpStream Recv() blocked on this
+// member instead of leaving it running against a connection nothing else
+// still references.
+func (p *peerExchangeMemberManager) dialMember(ctx context.Context, meta *MemberMeta) (dfdaemonclient.V1, dfdaemonv1.Daemon_PeerExchangeClient, error) {
 	formatIP, ok := ip.FormatIP(meta.IP)
 	if !ok {
 		return nil, nil, fmt.Errorf("failed to format ip: %s", meta.IP)
@@ -138,21 +225,42 @@ func (p *peerExchangeMemberManager) dialMember(meta *MemberMeta) (dfdaemonclient
 		Addr: fmt.Sprintf("%s:%d", formatIP, meta.RpcPort),
 	}
 
-	credentialOpt := grpc.WithTransportCredentials(p.GRPCCredentials)
+	credentialOpt := grpc.WithTransportCredentials(p.dialCredentials(meta.IP))
 
-	dialCtx, cancel := context.WithTimeout(context.Background(), p.GRPCDialTimeout)
-	grpcClient, err := dfdaemonclient.GetV1(dialCtx, netAddr.String(), credentialOpt, grpc.WithBlock())
+	dialStart := time.Now()
+	dialCtx, cancel := context.WithTimeout(ctx, p.GRPCDialTimeout)
+	grpcClient, err := dfdaemonclient.GetV1(dialCtx, netAddr.String(), credentialOpt, grpc.WithBlock(), grpc.WithKeepaliveParams(pexKeepaliveParams))
 	cancel()
+	p.metrics.observeDial(time.Since(dialStart))
 
 	if err != nil {
+		p.metrics.observeSyncError(causeDialFailed)
 		return nil, nil, fmt.Errorf("failed to dial grpc %s: %s", netAddr.String(), err)
 	}
 
-	peerExchangeClient, err := grpcClient.PeerExchange(context.Background())
+	peerExchangeClient, err := grpcClient.PeerExchange(ctx)
 	if err != nil {
 		_ = grpcClient.Close()
+		p.metrics.observeSyncError(causeDialFailed)
 		return nil, nil, fmt.Errorf("failed to call %s PeerExchange: %s", netAddr.String(), err)
 	}
 
 	return grpcClient, peerExchangeClient, nil
 }
+
+// dialCredentials returns the transport credentials to use when dialing
+// serverName. When a certificateSource is configured, it builds per-dial TLS
+// credentials pinned to serverName so that a compromised or misconfigured
+// peer cannot present a certificate for a different host. It takes the bare
+// server name rather than a *MemberMeta so it can be exercised without
+// depending on the rest of a member's metadata.
+func (p *peerExchangeMemberManager) dialCredentials(serverName string) credentials.TransportCredentials {
+	cfg := p.tlsConfig.Load()
+	if cfg == nil {
+		return p.GRPCCredentials
+	}
+
+	verifyCfg := cfg.Clone()
+	verifyCfg.ServerName = serverName
+	return credentials.NewTLS(verifyCfg)
+}
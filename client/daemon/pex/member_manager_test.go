@@ -0,0 +1,49 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestDialCredentialsFallsBackWithoutCertificateSource(t *testing.T) {
+	p := &peerExchangeMemberManager{GRPCCredentials: insecure.NewCredentials()}
+
+	got := p.dialCredentials("member.example.com")
+	if got != p.GRPCCredentials {
+		t.Fatalf("dialCredentials() = %v, want the fallback GRPCCredentials", got)
+	}
+}
+
+func TestDialCredentialsPinsServerName(t *testing.T) {
+	p := &peerExchangeMemberManager{GRPCCredentials: insecure.NewCredentials()}
+	p.tlsConfig.Store(&tls.Config{})
+
+	got := p.dialCredentials("member.example.com")
+	if got == p.GRPCCredentials {
+		t.Fatalf("dialCredentials() returned the fallback credentials despite a configured tlsConfig")
+	}
+	if info := got.Info(); info.SecurityProtocol != "tls" {
+		t.Fatalf("dialCredentials().Info().SecurityProtocol = %q, want %q", info.SecurityProtocol, "tls")
+	}
+	if info := got.Info(); info.ServerName != "member.example.com" {
+		t.Fatalf("dialCredentials().Info().ServerName = %q, want %q", info.ServerName, "member.example.com")
+	}
+}
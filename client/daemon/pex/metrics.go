@@ -0,0 +1,208 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	metricsNamespace = "dragonfly"
+	metricsSubsystem = "pex"
+)
+
+// pexMetrics groups every Prometheus collector exposed by the peer exchange
+// subsystem. It is nil-safe: a zero-value manager without a registerer
+// configured via WithPrometheusRegisterer skips instrumentation entirely.
+type pexMetrics struct {
+	membersTotal        prometheus.Gauge
+	peersTotal          *prometheus.GaugeVec
+	connectionStates    *prometheus.GaugeVec
+	memberEventsTotal   *prometheus.CounterVec
+	peerMetadataTotal   *prometheus.CounterVec
+	syncErrorsTotal     *prometheus.CounterVec
+	duplicateSuppressed prometheus.Counter
+	dialDuration        prometheus.Histogram
+	propagationLatency  prometheus.Histogram
+}
+
+func newPexMetrics(reg prometheus.Registerer) *pexMetrics {
+	factory := promauto.With(reg)
+
+	return &pexMetrics{
+		membersTotal: factory.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "members_total",
+			Help:      "Current number of tracked PEX members.",
+		}),
+		peersTotal: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "peers_total",
+			Help:      "Current number of distinct peers known per task.",
+		}, []string{"task"}),
+		connectionStates: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "connection_state_total",
+			Help:      "Current number of PEX connections in each state.",
+		}, []string{"state"}),
+		memberEventsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "member_events_total",
+			Help:      "Total number of memberlist join/leave/update events observed.",
+		}, []string{"event"}),
+		peerMetadataTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "peer_metadata_total",
+			Help:      "Total number of PeerMetadata messages sent or received.",
+		}, []string{"direction"}),
+		syncErrorsTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "sync_errors_total",
+			Help:      "Total number of PEX sync errors, classified by cause.",
+		}, []string{"cause"}),
+		duplicateSuppressed: factory.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "duplicate_suppressed_total",
+			Help:      "Total number of times a member was already registered and the duplicate join was suppressed.",
+		}),
+		dialDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "dial_duration_seconds",
+			Help:      "Latency of dialing another PEX member's gRPC endpoint.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		propagationLatency: factory.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "propagation_duration_seconds",
+			Help:      "End-to-end latency between a local piece completion and the corresponding PeerMetadata arriving from a remote peer.",
+			Buckets:   []float64{.01, .05, .1, .5, 1, 2, 5, 10, 30, 60},
+		}),
+	}
+}
+
+// syncErrorCause enumerates the sync_errors_total label values.
+type syncErrorCause string
+
+const (
+	causeDialFailed        syncErrorCause = "dial-failed"
+	causeStreamClosed      syncErrorCause = "stream-closed"
+	causeDecodeError       syncErrorCause = "decode-error"
+	causeAlreadyRegistered syncErrorCause = "already-registered"
+)
+
+func (m *pexMetrics) observeSyncError(cause syncErrorCause) {
+	if m == nil {
+		return
+	}
+	m.syncErrorsTotal.WithLabelValues(string(cause)).Inc()
+}
+
+func (m *pexMetrics) observeMemberEvent(event string) {
+	if m == nil {
+		return
+	}
+	m.memberEventsTotal.WithLabelValues(event).Inc()
+}
+
+func (m *pexMetrics) observeDuplicateSuppressed() {
+	if m == nil {
+		return
+	}
+	m.duplicateSuppressed.Inc()
+}
+
+func (m *pexMetrics) observeDial(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.dialDuration.Observe(duration.Seconds())
+}
+
+func (m *pexMetrics) observePeerMetadata(direction string) {
+	if m == nil {
+		return
+	}
+	m.peerMetadataTotal.WithLabelValues(direction).Inc()
+}
+
+func (m *pexMetrics) observePropagationSince(pushedAt time.Time) {
+	if m == nil || pushedAt.IsZero() {
+		return
+	}
+	m.propagationLatency.Observe(time.Since(pushedAt).Seconds())
+}
+
+// runMetricsRefresh periodically recomputes gauges that are cheapest to
+// derive from a full snapshot rather than updating incrementally on every
+// state transition.
+func (p *peerExchangeMemberManager) runMetricsRefresh(ctx context.Context) {
+	if p.metrics == nil {
+		return
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refreshMetrics()
+		}
+	}
+}
+
+func (p *peerExchangeMemberManager) refreshMetrics() {
+	infos := p.connections.Inspect()
+	p.metrics.membersTotal.Set(float64(len(infos)))
+
+	counts := map[string]int{
+		StateConnecting.String(): 0,
+		StateConnected.String():  0,
+		StateBackoff.String():    0,
+		StateClosed.String():     0,
+	}
+	for _, info := range infos {
+		counts[info.State]++
+	}
+	for state, count := range counts {
+		p.metrics.connectionStates.WithLabelValues(state).Set(float64(count))
+	}
+
+	// Reset before repopulating so a task that has lost every known peer
+	// (and so dropped out of peerCounts entirely, see digestState.evictMember)
+	// stops publishing its last, now-stale, count instead of lingering in
+	// the gauge forever.
+	p.metrics.peersTotal.Reset()
+	for task, count := range p.digest.peerCounts() {
+		p.metrics.peersTotal.WithLabelValues(task).Set(float64(count))
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultGRPCDialTimeout is used when the caller does not configure an
+// explicit dial timeout for the PEX gRPC client.
+const defaultGRPCDialTimeout = 10 * time.Second
+
+// CertificateSource supplies the *tls.Config used to dial other members of
+// the peer exchange cluster and notifies subscribers whenever the
+// certificate backing it is rotated, so that long-lived PEX connections can
+// be re-dialed with fresh credentials instead of authenticating with an
+// expired certificate. Implementations are typically backed by dfdaemon's
+// certificate manager.
+type CertificateSource interface {
+	// GetTLSConfig returns the current TLS configuration to dial peers with.
+	GetTLSConfig() *tls.Config
+
+	// Subscribe returns a channel that receives the updated *tls.Config
+	// every time the underlying certificate is renewed. The channel is
+	// closed when ctx is done.
+	Subscribe(ctx context.Context) <-chan *tls.Config
+}
+
+// Option configures a peerExchangeMemberManager.
+type Option func(*peerExchangeMemberManager)
+
+// WithGRPCDialTimeout sets the timeout used when dialing other PEX members.
+func WithGRPCDialTimeout(timeout time.Duration) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.GRPCDialTimeout = timeout
+	}
+}
+
+// WithAntiEntropyInterval overrides the base interval between periodic
+// push-pull anti-entropy reconciliation rounds.
+func WithAntiEntropyInterval(interval time.Duration) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.antiEntropyInterval = interval
+	}
+}
+
+// WithAntiEntropyFanout overrides how many members are contacted on each
+// anti-entropy round.
+func WithAntiEntropyFanout(fanout int) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.antiEntropyFanout = fanout
+	}
+}
+
+// WithGossipEncryption enables memberlist's built-in symmetric gossip
+// encryption. primaryKey is used to encrypt outgoing gossip; otherKeys are
+// additionally accepted for decryption, which is useful right after a key
+// rotation when not every node has picked up the new primary yet.
+// rotationGracePeriod controls how long a retired primary key set via
+// RotateGossipKey continues to be accepted.
+func WithGossipEncryption(primaryKey []byte, otherKeys [][]byte, rotationGracePeriod time.Duration) Option {
+	return func(p *peerExchangeMemberManager) {
+		keyring, err := newGossipKeyring(primaryKey, otherKeys, rotationGracePeriod)
+		if err != nil {
+			p.logger.Errorf("failed to enable gossip encryption: %s", err)
+			return
+		}
+		p.gossipKeyring = keyring
+	}
+}
+
+// WithSignedMeta enables signed MemberMeta. When signingKey is non-nil this
+// daemon signs its own advertisement; when trustAnchors is non-empty,
+// incoming advertisements are rejected unless they carry a valid signature
+// from one of the anchors.
+func WithSignedMeta(signingKey ed25519.PrivateKey, trustAnchors []ed25519.PublicKey) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.metaSecurity = &metaSecurity{
+			signingKey:   signingKey,
+			trustAnchors: trustAnchors,
+		}
+	}
+}
+
+// WithPrometheusRegisterer registers the PEX subsystem's Prometheus
+// collectors on reg, typically the daemon's existing registry. Metrics are
+// left disabled if this option is not used.
+func WithPrometheusRegisterer(reg prometheus.Registerer) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.metrics = newPexMetrics(reg)
+	}
+}
+
+// WithMemberDiscovery configures the backend used to bootstrap and re-heal
+// cluster membership, in place of relying solely on memberlist's own
+// multicast discovery or a hard-coded seed list. Call SetJoiner once the
+// *memberlist.Memberlist has been created for discovered addresses to
+// actually be joined.
+func WithMemberDiscovery(discovery MemberDiscovery) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.memberDiscovery = discovery
+	}
+}
+
+// WithCertificateSource enables TLS/mTLS for the PEX gRPC client, sourcing
+// the certificate from source and reconnecting existing members whenever
+// source reports that the certificate has been rotated.
+func WithCertificateSource(source CertificateSource) Option {
+	return func(p *peerExchangeMemberManager) {
+		p.certificateSource = source
+		if cfg := source.GetTLSConfig(); cfg != nil {
+			p.tlsConfig.Store(cfg)
+		}
+	}
+}
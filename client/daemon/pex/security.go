@@ -0,0 +1,175 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// gossipKeyring wraps memberlist's symmetric-key keyring with a grace
+// period for rotation: RotateKey installs a new primary key but keeps the
+// previous one accepted until the grace period elapses, so nodes that
+// haven't picked up the new key yet aren't partitioned out mid-rollout.
+type gossipKeyring struct {
+	mu          sync.Mutex
+	keyring     *memberlist.Keyring
+	gracePeriod time.Duration
+
+	// pendingRemovals tracks one scheduled removal per retired key, keyed by
+	// its raw bytes. Each rotation's removal runs on its own timer rather
+	// than sharing a single field, so rotating twice within one grace period
+	// (a realistic rolling-restart scenario) doesn't cancel the first
+	// rotation's pending cleanup and leak that key permanently.
+	pendingRemovals map[string]func()
+}
+
+// newGossipKeyring builds a keyring seeded with primaryKey (first) followed
+// by any additional keys still accepted for decryption (e.g. carried over
+// from a previous rotation).
+func newGossipKeyring(primaryKey []byte, otherKeys [][]byte, gracePeriod time.Duration) (*gossipKeyring, error) {
+	keyring, err := memberlist.NewKeyring(otherKeys, primaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build gossip keyring: %w", err)
+	}
+
+	return &gossipKeyring{
+		keyring:         keyring,
+		gracePeriod:     gracePeriod,
+		pendingRemovals: make(map[string]func()),
+	}, nil
+}
+
+// RotateKey installs newKey as the primary gossip encryption key. The
+// previously active primary key is kept in the ring so in-flight gossip
+// from nodes that haven't rotated yet still decrypts, and is dropped after
+// the configured grace period. With a non-positive grace period no removal
+// is scheduled and the previous key stays in the ring.
+func (g *gossipKeyring) RotateKey(newKey []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	previousPrimary := g.keyring.GetPrimaryKey()
+
+	if err := g.keyring.AddKey(newKey); err != nil {
+		return fmt.Errorf("failed to add rotated gossip key: %w", err)
+	}
+	if err := g.keyring.UseKey(newKey); err != nil {
+		return fmt.Errorf("failed to activate rotated gossip key: %w", err)
+	}
+
+	if previousPrimary != nil && g.gracePeriod > 0 {
+		g.scheduleRemoval(previousPrimary)
+	}
+
+	return nil
+}
+
+// scheduleRemoval arranges for key to be dropped from the keyring once
+// gracePeriod elapses. Must be called with g.mu held.
+func (g *gossipKeyring) scheduleRemoval(key []byte) {
+	id := string(key)
+	if _, scheduled := g.pendingRemovals[id]; scheduled {
+		// Already on its way out from an earlier rotation (e.g. the ring
+		// rotated back to a key still in its grace period); let that timer
+		// stand rather than resetting the clock.
+		return
+	}
+
+	timer := time.AfterFunc(g.gracePeriod, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		_ = g.keyring.RemoveKey(key)
+		delete(g.pendingRemovals, id)
+	})
+	g.pendingRemovals[id] = func() { timer.Stop() }
+}
+
+// metaSecurity holds the optional signing key used to sign this daemon's
+// own advertised MemberMeta, and the trust anchors used to verify other
+// members' advertisements.
+type metaSecurity struct {
+	signingKey   ed25519.PrivateKey
+	trustAnchors []ed25519.PublicKey
+}
+
+// signedMetaEnvelope is the wire format used for node.Meta once signed-meta
+// is enabled: the original MemberMeta JSON, untouched, plus a detached
+// signature over it.
+type signedMetaEnvelope struct {
+	Meta      json.RawMessage `json:"meta"`
+	Signature []byte          `json:"signature,omitempty"`
+}
+
+// MarshalNodeMeta encodes meta into the bytes that should be advertised as
+// this daemon's memberlist.Node.Meta, signing it with the configured
+// identity key when signed-meta is enabled.
+func (p *peerExchangeMemberManager) MarshalNodeMeta(meta *MemberMeta) ([]byte, error) {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.metaSecurity == nil || p.metaSecurity.signingKey == nil {
+		return raw, nil
+	}
+
+	envelope := signedMetaEnvelope{
+		Meta:      raw,
+		Signature: ed25519.Sign(p.metaSecurity.signingKey, raw),
+	}
+	return json.Marshal(envelope)
+}
+
+// verifiedNodeMeta extracts and, if signed-meta is enabled, verifies the
+// MemberMeta advertised by node against the configured trust anchors,
+// rejecting nodes whose signature doesn't match any of them.
+func (p *peerExchangeMemberManager) verifiedNodeMeta(node *memberlist.Node) (*MemberMeta, error) {
+	if p.metaSecurity == nil || len(p.metaSecurity.trustAnchors) == 0 {
+		return ExtractNodeMeta(node)
+	}
+
+	var envelope signedMetaEnvelope
+	if err := json.Unmarshal(node.Meta, &envelope); err != nil || len(envelope.Meta) == 0 {
+		return nil, fmt.Errorf("node %s did not advertise signed meta but signed-meta is required", node.Addr.String())
+	}
+
+	var verified bool
+	for _, anchor := range p.metaSecurity.trustAnchors {
+		if ed25519.Verify(anchor, envelope.Meta, envelope.Signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("node %s advertised meta with a signature not matching any trust anchor", node.Addr.String())
+	}
+
+	nodeMeta := &MemberMeta{}
+	if err := json.Unmarshal(envelope.Meta, nodeMeta); err != nil {
+		return nil, err
+	}
+	if nodeMeta.IP == "" {
+		nodeMeta.IP = node.Addr.String()
+	}
+	return nodeMeta, nil
+}
@@ -0,0 +1,89 @@
+/*
+ *     Copyright 2023 The Dragonfly Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *      http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pex
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestGossipKeyring(t *testing.T, gracePeriod time.Duration) *gossipKeyring {
+	t.Helper()
+
+	g, err := newGossipKeyring(make([]byte, 16), nil, gracePeriod)
+	if err != nil {
+		t.Fatalf("newGossipKeyring() failed: %s", err)
+	}
+	return g
+}
+
+func TestGossipKeyringRotateKeySchedulesRemoval(t *testing.T) {
+	g := newTestGossipKeyring(t, time.Hour)
+	previous := g.keyring.GetPrimaryKey()
+
+	if err := g.RotateKey(make([]byte, 16)); err != nil {
+		t.Fatalf("RotateKey() failed: %s", err)
+	}
+
+	if _, scheduled := g.pendingRemovals[string(previous)]; !scheduled {
+		t.Fatalf("RotateKey() did not schedule removal of the previous primary key")
+	}
+}
+
+func TestGossipKeyringRotateTwiceWithinGracePeriodDoesNotLeakSchedule(t *testing.T) {
+	g := newTestGossipKeyring(t, time.Hour)
+	first := g.keyring.GetPrimaryKey()
+
+	key2 := make([]byte, 16)
+	key2[0] = 1
+	if err := g.RotateKey(key2); err != nil {
+		t.Fatalf("first RotateKey() failed: %s", err)
+	}
+
+	// Rotating back to the still-pending-removal first key must not reset or
+	// duplicate its scheduled removal; the now-retired key2 gets its own.
+	if err := g.RotateKey(first); err != nil {
+		t.Fatalf("second RotateKey() failed: %s", err)
+	}
+
+	if got := len(g.pendingRemovals); got != 2 {
+		t.Fatalf("pendingRemovals has %d entries, want 2 (one per retired key, with no duplicate for the first key)", got)
+	}
+}
+
+func TestGossipKeyringScheduleRemovalDropsKeyAfterGracePeriod(t *testing.T) {
+	g := newTestGossipKeyring(t, 10*time.Millisecond)
+	previous := g.keyring.GetPrimaryKey()
+
+	newKey := make([]byte, 16)
+	newKey[0] = 1
+	if err := g.RotateKey(newKey); err != nil {
+		t.Fatalf("RotateKey() failed: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		_, scheduled := g.pendingRemovals[string(previous)]
+		g.mu.Unlock()
+		if !scheduled {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("previous primary key's removal was not processed within the grace period")
+}